@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/restic/restic/internal/debug"
@@ -14,9 +15,52 @@ import (
 type Restorer2 struct {
 	Restorer
 
-	workers int
-	cfire   chan *restoreTask
-	cback   chan *restoreTask
+	// PackWorkers is the number of goroutines that fetch and decrypt packs
+	// during the content-restore phase. FileWriters is the number of
+	// goroutines that scatter decrypted blobs onto the target files. Both
+	// default to workers when left at zero.
+	PackWorkers int
+	FileWriters int
+
+	// SparseFiles turns runs of at least sparseBlockSize zero bytes
+	// (including entirely zero blobs of that size or more) into filesystem
+	// holes instead of writing them out, see restorer2_sparse.go.
+	SparseFiles bool
+
+	// VerifyExisting makes resume (see restorer2_resume.go) re-hash files
+	// the journal claims are already restored instead of trusting their
+	// size and modification time.
+	VerifyExisting bool
+	journal        *journal
+
+	// OverwritePolicy decides what happens when a destination path already
+	// exists; ConflictHandler, if set, overrides it on a per-path basis.
+	// See restorer2_conflict.go.
+	OverwritePolicy OverwritePolicy
+	ConflictHandler ConflictHandler
+
+	// MaxPendingFiles bounds how many files' worth of blob needs
+	// res.packPlan/res.pending/res.files may accumulate before the walk
+	// pauses to drain them through restorePacks. Left at zero it defaults
+	// to defaultMaxPendingFiles. Without this, restoring a snapshot with
+	// millions of files would keep every one of their blob needs in
+	// memory at once.
+	MaxPendingFiles int
+
+	// MaxPendingTasks bounds how many entries res.dirTasks/res.nodeTasks
+	// may hold before the walk pauses to drain them: dispatching queued
+	// node tasks to a free worker, or blocking for one to finish, the
+	// same way maybeFlushPacks bounds res.packPlan/res.pending/res.files.
+	// Left at zero it defaults to defaultMaxPendingTasks. Without this, a
+	// single directory containing millions of symlinks, hardlinks,
+	// special files or subdirectories would queue all of them in memory
+	// before a single worker ever got to run.
+	MaxPendingTasks int
+
+	workers   int
+	available int
+	cfire     chan *restoreTask
+	cback     chan *restoreTask
 
 	dst string
 	ctx context.Context
@@ -24,6 +68,15 @@ type Restorer2 struct {
 
 	dirTasks  []*restoreTask
 	nodeTasks []*restoreTask
+
+	// packPlan and pending are built during the walk phase and drained
+	// during the pack phase; see restorer2_pack.go. mu guards the
+	// directory-completion bookkeeping (child/subdir counters) once
+	// multiple FileWriters can finish files concurrently.
+	packPlan map[ID][]Blob
+	pending  map[ID][]blobNeed
+	files    map[string]*pendingFile
+	mu       sync.Mutex
 }
 
 type restoreTask struct {
@@ -51,13 +104,18 @@ func (task *restoreTask) checkCompeleted() error {
 	}
 
 	if task.child == 0 && task.subdir == 0 {
-		if err := task.node.RestoreTimestamps(task.dir); err != nil {
-			return err
+		// The root dir task has no Node of its own (it isn't an entry in
+		// any tree, there's nothing to restore timestamps from) and is
+		// left out of this.
+		if task.node != nil {
+			if err := task.node.RestoreTimestamps(filepath.Join(task.res.dst, task.dir)); err != nil {
+				return err
+			}
 		}
 
 		if task.parent != nil {
 			task.parent.child--
-			return task.checkCompeleted()
+			return task.parent.checkCompeleted()
 		}
 	}
 	return nil
@@ -70,7 +128,19 @@ func (task *restoreTask) restoreNodeTo() {
 	debug.Log("node %v, dir %v, dst %v", node.Name, dir, dst)
 	dstPath := filepath.Join(dst, dir, node.Name)
 
-	err := node.CreateAt(ctx, dstPath, repo, idx)
+	target, _, err := res.planDestination(dstPath, node)
+	if err != nil {
+		task.err = res.Error(dstPath, node, err)
+		return
+	}
+	if target == "" {
+		debug.Log("skip %v: overwrite policy", dstPath)
+		task.err = nil
+		return
+	}
+	dstPath = target
+
+	err = node.CreateAt(ctx, dstPath, repo, idx)
 	if err != nil {
 		debug.Log("node.CreateAt(%s) error %v", dstPath, err)
 	}
@@ -134,16 +204,25 @@ func newNodeTask(res *Restorer2, parent *restoreTask, dir string, node *Node) *r
 	}
 }
 
-func newDirTask(res *Restorer2, parent *restoreTask, dir string, treeID ID) *restoreTask {
+// newDirTask builds a dir task for the subtree rooted at dir. node is the
+// Node describing this directory in its parent's tree, used to restore its
+// timestamps once every child has finished; it's nil for the restore
+// root, which isn't an entry in any tree.
+func newDirTask(res *Restorer2, parent *restoreTask, dir string, treeID ID, node *Node) *restoreTask {
 	return &restoreTask{
 		res:    res,
 		parent: parent,
 		class:  "dir",
 		dir:    dir,
 		treeID: treeID,
+		node:   node,
 	}
 }
 
+// restoreDir walks a single tree, creating directories immediately, queuing
+// symlinks, special files and hardlinks as node tasks for the workers, and
+// handing every plain file that still has content to restore off to the
+// pack-aware pipeline via planFile.
 func (res *Restorer2) restoreDir(task *restoreTask) error {
 	ctx, dst := res.ctx, res.dst
 	dir, treeID := task.dir, task.treeID
@@ -165,7 +244,7 @@ func (res *Restorer2) restoreDir(task *restoreTask) error {
 			}
 
 			subp := filepath.Join(dir, node.Name)
-			res.addDirTask(task, subp, *node.Subtree)
+			res.addDirTask(task, subp, *node.Subtree, node)
 
 			if selectedForRestore {
 				mkdirTask := newNodeTask(res, nil, dir, node)
@@ -177,68 +256,146 @@ func (res *Restorer2) restoreDir(task *restoreTask) error {
 			}
 
 			task.subdir++
+			if err := res.maybeDrainTasks(); err != nil {
+				return err
+			}
 			continue
 		}
 
-		if selectedForRestore {
-			res.addNodeTask(task, dir, node)
+		if !selectedForRestore {
+			continue
+		}
+
+		if node.Type == "file" && node.Links <= 1 && len(node.Content) > 0 {
 			task.child++
+			if err := res.planFile(task, dir, node); err != nil {
+				return err
+			}
 			continue
 		}
+
+		res.addNodeTask(task, dir, node)
+		task.child++
+		if err := res.maybeDrainTasks(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (res *Restorer2) restoreMain() error {
-	available := res.workers
-	var tasks int
-	var task *restoreTask
+// defaultMaxPendingTasks is used when Restorer2.MaxPendingTasks is left at
+// its zero value.
+const defaultMaxPendingTasks = 4096
+
+// dispatchOne makes one unit of progress on the walk: it sends the next
+// queued node task to a free worker, or, if none is queued, walks the
+// next queued directory task. It reports whether it did either, so callers
+// know whether to fall back to waiting on cback instead.
+func (res *Restorer2) dispatchOne() (bool, error) {
+	if res.available <= 0 {
+		return false, nil
+	}
 
-	for {
-		if available > 0 {
-			tasks = len(res.nodeTasks)
-			if tasks > 0 {
-				task, res.nodeTasks = res.nodeTasks[tasks-1], res.nodeTasks[:tasks-1]
-				res.cfire <- task
-				available--
-				continue
-			}
+	if n := len(res.nodeTasks); n > 0 {
+		var task *restoreTask
+		task, res.nodeTasks = res.nodeTasks[n-1], res.nodeTasks[:n-1]
+		res.cfire <- task
+		res.available--
+		return true, nil
+	}
 
-			tasks = len(res.dirTasks)
-			if tasks > 0 {
-				task, res.dirTasks = res.dirTasks[tasks-1], res.dirTasks[:tasks-1]
-				err := res.restoreDir(task)
-				if err != nil {
-					return err
-				}
-				continue
-			}
+	if n := len(res.dirTasks); n > 0 {
+		var task *restoreTask
+		task, res.dirTasks = res.dirTasks[n-1], res.dirTasks[:n-1]
+		if err := res.restoreDir(task); err != nil {
+			return false, err
 		}
+		return true, nil
+	}
 
-		if available == res.workers {
-			return nil
+	return false, nil
+}
+
+// waitBack blocks for the next worker to finish and applies its result to
+// the task tree. It reports false once cback is closed, which only happens
+// while RestoreTo is tearing down.
+func (res *Restorer2) waitBack() (bool, error) {
+	task, ok := <-res.cback
+	if !ok {
+		return false, nil
+	}
+	res.available++
+
+	if task.err != nil {
+		return true, task.err
+	}
+
+	if task.parent != nil && task.class == "node" {
+		task.parent.child--
+		if err := task.parent.checkCompeleted(); err != nil {
+			return true, err
 		}
+	}
+	return true, nil
+}
 
-		task, ok := <-res.cback
+// maybeDrainTasks keeps res.dirTasks+res.nodeTasks from growing past
+// MaxPendingTasks while a single directory is being walked. A directory
+// with millions of entries would otherwise queue all of them, in memory,
+// before restoreMain ever got a chance to dispatch one. It reuses the same
+// dispatch-or-wait logic restoreMain uses once the walk itself is done.
+func (res *Restorer2) maybeDrainTasks() error {
+	for len(res.dirTasks)+len(res.nodeTasks) > res.MaxPendingTasks {
+		dispatched, err := res.dispatchOne()
+		if err != nil {
+			return err
+		}
+		if dispatched {
+			continue
+		}
 
-		if !ok {
-			return nil
+		more, err := res.waitBack()
+		if err != nil {
+			return err
+		}
+		if !more {
+			return errors.New("restore workers stopped before the walk finished")
 		}
-		available++
+	}
+	return nil
+}
+
+func (res *Restorer2) restoreMain() error {
+	res.available = res.workers
 
-		if task.err != nil {
-			return task.err
+	for {
+		dispatched, err := res.dispatchOne()
+		if err != nil {
+			return err
+		}
+		if dispatched {
+			continue
 		}
 
-		if task.parent != nil {
-			if task.class == "node" {
-				task.parent.child--
-				if err := task.parent.checkCompeleted(); err != nil {
-					return err
-				}
-			}
+		if res.available == res.workers {
+			break
+		}
+
+		more, err := res.waitBack()
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
 		}
 	}
+
+	// Walk phase is done: every directory, symlink, special file and
+	// hardlink has been created. Whatever is still in res.packPlan/
+	// res.pending is the last, partial batch that hadn't hit
+	// MaxPendingFiles yet; flush it the same way every earlier batch was
+	// flushed during the walk.
+	return res.flushPacks()
 }
 
 func (res *Restorer2) addNodeTask(parent *restoreTask, dir string, node *Node) *restoreTask {
@@ -247,8 +404,8 @@ func (res *Restorer2) addNodeTask(parent *restoreTask, dir string, node *Node) *
 	return task
 }
 
-func (res *Restorer2) addDirTask(parent *restoreTask, dir string, treeID ID) *restoreTask {
-	task := newDirTask(res, parent, dir, treeID)
+func (res *Restorer2) addDirTask(parent *restoreTask, dir string, treeID ID, node *Node) *restoreTask {
+	task := newDirTask(res, parent, dir, treeID, node)
 	res.dirTasks = append(res.dirTasks, task)
 	return task
 }
@@ -260,13 +417,31 @@ func (res *Restorer2) RestoreTo(ctx context.Context, dst string) error {
 	res.idx = NewHardlinkIndex()
 	res.dst = dst
 
+	if res.PackWorkers <= 0 {
+		res.PackWorkers = res.workers
+	}
+	if res.FileWriters <= 0 {
+		res.FileWriters = res.workers
+	}
+	if res.MaxPendingFiles <= 0 {
+		res.MaxPendingFiles = defaultMaxPendingFiles
+	}
+	if res.MaxPendingTasks <= 0 {
+		res.MaxPendingTasks = defaultMaxPendingTasks
+	}
+
 	res.cfire = make(chan *restoreTask)
 	res.cback = make(chan *restoreTask)
 
-	res.dirTasks = make([]*restoreTask, 100)
-	res.nodeTasks = make([]*restoreTask, 100)
+	res.dirTasks = make([]*restoreTask, 0, 100)
+	res.nodeTasks = make([]*restoreTask, 0, 100)
+
+	res.packPlan = make(map[ID][]Blob)
+	res.pending = make(map[ID][]blobNeed)
+	res.files = make(map[string]*pendingFile)
+	res.journal = loadJournal(dst, *res.sn.Tree)
 
-	res.addDirTask(nil, string(filepath.Separator), *res.sn.Tree)
+	res.addDirTask(nil, string(filepath.Separator), *res.sn.Tree, nil)
 
 	// start worker pool
 	for i := 0; i < res.workers; i++ {
@@ -281,6 +456,10 @@ func (res *Restorer2) RestoreTo(ctx context.Context, dst string) error {
 	res.cfire = nil
 	res.cback = nil
 
+	if err == nil {
+		res.journal.done()
+	}
+
 	return err
 }
 
@@ -0,0 +1,164 @@
+package restic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveConflictOverwritePolicies(t *testing.T) {
+	older := time.Now().Add(-time.Hour)
+	newer := time.Now()
+
+	dst := t.TempDir()
+	path := filepath.Join(dst, "file")
+	if err := os.WriteFile(path, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name   string
+		policy OverwritePolicy
+		node   *Node
+		want   OverwriteAction
+	}{
+		{"always replaces", OverwriteAlways, &Node{}, OverwriteActionReplace},
+		{"never skips", OverwriteNever, &Node{}, OverwriteActionSkip},
+		{"if newer, older node skips", OverwriteIfNewer, &Node{ModTime: older}, OverwriteActionSkip},
+		{"if newer, newer node replaces", OverwriteIfNewer, &Node{ModTime: newer.Add(time.Hour)}, OverwriteActionReplace},
+		{
+			"if different, matching size+mtime skips",
+			OverwriteIfDifferent,
+			&Node{Size: uint64(existing.Size()), ModTime: existing.ModTime()},
+			OverwriteActionSkip,
+		},
+		{
+			"if different, mismatched size replaces",
+			OverwriteIfDifferent,
+			&Node{Size: uint64(existing.Size()) + 1, ModTime: existing.ModTime()},
+			OverwriteActionReplace,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &Restorer2{OverwritePolicy: tt.policy}
+			if got := res.resolveConflict(existing, tt.node); got != tt.want {
+				t.Errorf("resolveConflict() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveConflictHandlerOverridesPolicy(t *testing.T) {
+	res := &Restorer2{
+		OverwritePolicy: OverwriteAlways,
+		ConflictHandler: func(os.FileInfo, *Node) OverwriteAction { return OverwriteActionSkip },
+	}
+
+	dst := t.TempDir()
+	path := filepath.Join(dst, "file")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := res.resolveConflict(existing, &Node{}); got != OverwriteActionSkip {
+		t.Errorf("resolveConflict() = %v, want %v (ConflictHandler should win over OverwritePolicy)", got, OverwriteActionSkip)
+	}
+}
+
+func TestPlanDestinationNoConflict(t *testing.T) {
+	res := &Restorer2{}
+	dstPath := filepath.Join(t.TempDir(), "file")
+
+	target, replacing, err := res.planDestination(dstPath, &Node{Type: "file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != dstPath || replacing {
+		t.Errorf("planDestination() = (%q, %v), want (%q, false)", target, replacing, dstPath)
+	}
+}
+
+func TestPlanDestinationSkip(t *testing.T) {
+	res := &Restorer2{OverwritePolicy: OverwriteNever}
+	dst := t.TempDir()
+	dstPath := filepath.Join(dst, "file")
+	if err := os.WriteFile(dstPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target, replacing, err := res.planDestination(dstPath, &Node{Type: "file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "" || replacing {
+		t.Errorf("planDestination() = (%q, %v), want (\"\", false)", target, replacing)
+	}
+}
+
+func TestPlanDestinationRename(t *testing.T) {
+	res := &Restorer2{ConflictHandler: func(os.FileInfo, *Node) OverwriteAction { return OverwriteActionRename }}
+	dst := t.TempDir()
+	dstPath := filepath.Join(dst, "file")
+	if err := os.WriteFile(dstPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target, replacing, err := res.planDestination(dstPath, &Node{Type: "file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dstPath + ".restic-conflict-1"
+	if target != want || replacing {
+		t.Errorf("planDestination() = (%q, %v), want (%q, false)", target, replacing, want)
+	}
+}
+
+func TestPlanDestinationReplace(t *testing.T) {
+	res := &Restorer2{OverwritePolicy: OverwriteAlways}
+	dst := t.TempDir()
+	dstPath := filepath.Join(dst, "file")
+	if err := os.WriteFile(dstPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target, replacing, err := res.planDestination(dstPath, &Node{Type: "file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != dstPath || !replacing {
+		t.Errorf("planDestination() = (%q, %v), want (%q, true)", target, replacing, dstPath)
+	}
+}
+
+// TestPlanDestinationNeverRenamesOrSkipsDirectories checks that a
+// directory conflict is always treated as mkdir -p, regardless of
+// OverwritePolicy/ConflictHandler: restoreDir queues every child of the
+// subtree against dstPath before the conflict is resolved, so renaming or
+// skipping the directory itself would orphan or misplace all of them.
+func TestPlanDestinationNeverRenamesOrSkipsDirectories(t *testing.T) {
+	res := &Restorer2{ConflictHandler: func(os.FileInfo, *Node) OverwriteAction { return OverwriteActionRename }}
+	dst := t.TempDir()
+	dstPath := filepath.Join(dst, "dir")
+	if err := os.Mkdir(dstPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	target, replacing, err := res.planDestination(dstPath, &Node{Type: "dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != dstPath || replacing {
+		t.Errorf("planDestination() = (%q, %v), want (%q, false)", target, replacing, dstPath)
+	}
+}
@@ -0,0 +1,38 @@
+package restic
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/restic/restic/internal/fs"
+)
+
+// createSizedFile creates dstPath (and any missing parent directories),
+// truncated to node's final content size, and applies its mode. Timestamps
+// are deferred until all of the file's blobs have been written, see
+// writeScatter.
+func (res *Restorer2) createSizedFile(dstPath string, node *Node) error {
+	if err := fs.MkdirAll(filepath.Dir(dstPath), 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	f, err := fs.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, node.Mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if res.SparseFiles {
+		if err := markSparse(f); err != nil {
+			return err
+		}
+	}
+
+	return f.Truncate(int64(node.Size))
+}
+
+// openForWrite reopens a file previously created by createSizedFile so a
+// FileWriters goroutine can scatter one blob into it.
+func (res *Restorer2) openForWrite(dstPath string) (*os.File, error) {
+	return fs.OpenFile(dstPath, os.O_WRONLY, 0)
+}
@@ -0,0 +1,301 @@
+package restic
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/pack"
+)
+
+// blobNeed records that the plaintext of a single blob must be written at
+// offset inside the file at dstPath. The same blob can appear in several
+// blobNeed entries when deduplication means more than one file (or more
+// than one position in the same file) shares it.
+type blobNeed struct {
+	dstPath string
+	offset  int64
+}
+
+// pendingFile tracks how many of a file's blobs are still outstanding. Once
+// remaining reaches zero, writePath is renamed onto finalPath if they
+// differ, timestamps/permissions are applied, and the completion cascades
+// up to its parent directory task.
+type pendingFile struct {
+	mu        sync.Mutex
+	node      *Node
+	dir       *restoreTask
+	remaining int
+	// origPath is the pre-conflict-resolution destination planFile was
+	// asked to restore, i.e. what canSkipRestore will be asked about on a
+	// future resume. finalPath is where the content actually landed,
+	// which differs from origPath when OverwriteActionRename renamed it
+	// aside; recordDone must journal the former while reading/hashing the
+	// latter, or a resumed run can never find what it already restored.
+	origPath  string
+	finalPath string
+}
+
+// planFile adds node's blobs to res.packPlan/res.pending without touching
+// disk, beyond creating the file that will receive them. It is called from
+// the single-threaded walk phase, so the maps it fills in don't need
+// locking.
+//
+// If the resume journal (see restorer2_resume.go) already has dstPath
+// recorded as done and matching what's on disk, planFile skips it outright
+// and completes parent itself instead of queuing any blobs. Otherwise the
+// overwrite policy (see restorer2_conflict.go) is consulted: it may skip
+// the file, redirect it to a renamed path, or, when it's replacing a
+// preexisting file at dstPath, route the restore through a temp file that
+// is only renamed onto dstPath once every blob has landed.
+func (res *Restorer2) planFile(parent *restoreTask, dir string, node *Node) error {
+	dstPath := filepath.Join(res.dst, dir, node.Name)
+
+	if res.canSkipRestore(dstPath) {
+		parent.child--
+		return parent.checkCompeleted()
+	}
+
+	target, replacingExisting, err := res.planDestination(dstPath, node)
+	if err != nil {
+		return res.Error(dstPath, node, err)
+	}
+	if target == "" {
+		debug.Log("skip %v: overwrite policy", dstPath)
+		parent.child--
+		return parent.checkCompeleted()
+	}
+
+	writePath := target
+	if replacingExisting {
+		writePath = target + ".restic-tmp"
+	}
+
+	if err := res.createSizedFile(writePath, node); err != nil {
+		return res.Error(target, node, err)
+	}
+
+	res.files[writePath] = &pendingFile{node: node, dir: parent, remaining: len(node.Content), origPath: dstPath, finalPath: target}
+
+	var offset int64
+	for _, blobID := range node.Content {
+		size, found := res.repo.LookupBlobSize(blobID, DataBlob)
+		if !found {
+			return res.Error(target, node, errors.Errorf("blob %v not found in any pack", blobID.Str()))
+		}
+
+		packs := res.repo.Index().Lookup(BlobHandle{ID: blobID, Type: DataBlob})
+		if len(packs) == 0 {
+			return res.Error(target, node, errors.Errorf("blob %v not found in any pack", blobID.Str()))
+		}
+		packID := packs[0].PackID
+
+		res.pending[blobID] = append(res.pending[blobID], blobNeed{dstPath: writePath, offset: offset})
+		res.addPackBlob(packID, packs[0].Blob)
+
+		offset += int64(size)
+	}
+
+	return res.maybeFlushPacks()
+}
+
+// defaultMaxPendingFiles is used when Restorer2.MaxPendingFiles is left at
+// its zero value.
+const defaultMaxPendingFiles = 4096
+
+// maybeFlushPacks drains the current batch through restorePacks once
+// res.files has grown to MaxPendingFiles, so memory use stays bounded
+// regardless of how many files the snapshot contains.
+func (res *Restorer2) maybeFlushPacks() error {
+	if len(res.files) < res.MaxPendingFiles {
+		return nil
+	}
+	return res.flushPacks()
+}
+
+// flushPacks restores every blob need accumulated so far and resets the
+// per-batch state, ready for the walk to build the next batch. It's also
+// where the resume journal hits disk: recordDone only updates res.journal
+// in memory, so batching the write here instead of doing it per file keeps
+// journal I/O proportional to the number of batches, not the number of
+// files.
+func (res *Restorer2) flushPacks() error {
+	if err := res.restorePacks(); err != nil {
+		return err
+	}
+
+	res.packPlan = make(map[ID][]Blob)
+	res.pending = make(map[ID][]blobNeed)
+	res.files = make(map[string]*pendingFile)
+
+	_ = res.journal.flush()
+	return nil
+}
+
+// addPackBlob keeps res.packPlan as the deduplicated list of Blob headers
+// that must be requested from a given pack.
+func (res *Restorer2) addPackBlob(packID ID, blob Blob) {
+	for _, b := range res.packPlan[packID] {
+		if b.ID == blob.ID {
+			return
+		}
+	}
+	res.packPlan[packID] = append(res.packPlan[packID], blob)
+}
+
+type writeJob struct {
+	dstPath string
+	offset  int64
+	blobID  ID
+	data    []byte
+}
+
+// restorePacks runs the pack phase: PackWorkers goroutines each fetch and
+// decrypt one pack at a time, while FileWriters goroutines scatter the
+// resulting plaintext onto every file that needs it.
+func (res *Restorer2) restorePacks() error {
+	if len(res.packPlan) == 0 {
+		return nil
+	}
+
+	packIDs := make([]ID, 0, len(res.packPlan))
+	for id := range res.packPlan {
+		packIDs = append(packIDs, id)
+	}
+
+	writes := make(chan writeJob, res.FileWriters)
+	writeErr := res.runWriters(writes)
+
+	packCh := make(chan ID)
+	var packWG sync.WaitGroup
+	packWG.Add(res.PackWorkers)
+
+	var packErrOnce sync.Once
+	var packErr error
+	for i := 0; i < res.PackWorkers; i++ {
+		go func() {
+			defer packWG.Done()
+			for packID := range packCh {
+				if err := res.restorePack(packID, writes); err != nil {
+					packErrOnce.Do(func() { packErr = err })
+				}
+			}
+		}()
+	}
+
+	for _, id := range packIDs {
+		packCh <- id
+	}
+	close(packCh)
+	packWG.Wait()
+	close(writes)
+
+	if err := <-writeErr; err != nil {
+		return err
+	}
+	return packErr
+}
+
+// runWriters starts res.FileWriters goroutines draining writes and returns a
+// channel that yields the first write error once every writer has exited.
+func (res *Restorer2) runWriters(writes <-chan writeJob) <-chan error {
+	done := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(res.FileWriters)
+
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < res.FileWriters; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range writes {
+				if err := res.writeScatter(job); err != nil {
+					once.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		done <- firstErr
+	}()
+
+	return done
+}
+
+// restorePack downloads and decrypts packID exactly once, then pushes one
+// writeJob per scattered destination for each blob it contains.
+func (res *Restorer2) restorePack(packID ID, writes chan<- writeJob) error {
+	blobs := res.packPlan[packID]
+	debug.Log("restoring pack %v (%d distinct blobs)", packID.Str(), len(blobs))
+
+	return pack.StreamPack(res.ctx, res.repo.Backend().Load, res.repo.Key(), packID, blobs,
+		func(blob BlobHandle, buf []byte, err error) error {
+			if err != nil {
+				return res.Error(packID.Str(), nil, err)
+			}
+
+			for _, need := range res.pending[blob.ID] {
+				data := make([]byte, len(buf))
+				copy(data, buf)
+				writes <- writeJob{dstPath: need.dstPath, offset: need.offset, blobID: blob.ID, data: data}
+			}
+			return nil
+		})
+}
+
+// writeScatter writes a single decrypted blob to its destination offset and,
+// once a file's last blob has landed, finalizes its timestamps/permissions
+// and cascades completion up to its parent directory task.
+func (res *Restorer2) writeScatter(job writeJob) error {
+	f, err := res.openForWrite(job.dstPath)
+	if err != nil {
+		return res.Error(job.dstPath, nil, err)
+	}
+
+	err = res.writeSparseData(f, job.offset, job.data)
+	closeErr := f.Close()
+	if err != nil {
+		return res.Error(job.dstPath, nil, err)
+	}
+	if closeErr != nil {
+		return res.Error(job.dstPath, nil, closeErr)
+	}
+
+	pf := res.files[job.dstPath]
+	pf.mu.Lock()
+	pf.remaining--
+	done := pf.remaining == 0
+	pf.mu.Unlock()
+
+	if !done {
+		return nil
+	}
+
+	if job.dstPath != pf.finalPath {
+		if err := os.Rename(job.dstPath, pf.finalPath); err != nil {
+			return res.Error(pf.finalPath, pf.node, err)
+		}
+	}
+
+	if err := os.Chmod(pf.finalPath, pf.node.Mode); err != nil {
+		return res.Error(pf.finalPath, pf.node, err)
+	}
+	if err := pf.node.RestoreTimestamps(pf.finalPath); err != nil {
+		return res.Error(pf.finalPath, pf.node, err)
+	}
+	res.recordDone(pf.origPath, pf.finalPath)
+
+	if pf.dir == nil {
+		return nil
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	pf.dir.child--
+	return pf.dir.checkCompeleted()
+}
@@ -0,0 +1,178 @@
+package restic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journalFileName is the resume journal restic writes at the root of every
+// restore, so an interrupted RestoreTo can pick up where it left off.
+const journalFileName = ".restic-restore-state.json"
+
+// journalFileState is what the journal remembers about one restored file,
+// keyed by the pre-conflict-resolution destination path (see
+// Restorer2.canSkipRestore). Hash is only populated so that a later run
+// with VerifyExisting can catch on-disk changes that size+mtime would
+// miss.
+type journalFileState struct {
+	// Path is where the content actually landed, if that differs from
+	// the key it's journaled under: a rename conflict (see
+	// restorer2_conflict.go) restores alongside the original destination
+	// instead of onto it. Empty means the content is at the key itself.
+	Path    string    `json:"path,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash,omitempty"`
+	Done    bool      `json:"done"`
+}
+
+// journal is the on-disk restore-progress record for one (tree, dst) pair.
+// A journal loaded for a different tree or target is treated as empty:
+// nothing it records is safe to trust for this run.
+type journal struct {
+	RootTree string                       `json:"root_tree"`
+	Target   string                       `json:"target"`
+	Files    map[string]*journalFileState `json:"files"`
+
+	mu   sync.Mutex
+	path string
+}
+
+func loadJournal(dst string, rootTree ID) *journal {
+	j := &journal{
+		path:     filepath.Join(dst, journalFileName),
+		RootTree: rootTree.String(),
+		Target:   dst,
+		Files:    make(map[string]*journalFileState),
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		return j
+	}
+
+	var onDisk journal
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		return j
+	}
+	if onDisk.RootTree != j.RootTree || onDisk.Target != j.Target || onDisk.Files == nil {
+		return j
+	}
+
+	j.Files = onDisk.Files
+	return j
+}
+
+func (j *journal) get(path string) *journalFileState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Files[path]
+}
+
+// update records path's latest state in memory. It does not persist the
+// journal itself; callers batch updates and call flush at a convenient
+// boundary (see Restorer2.flushPacks) so that restoring N files doesn't
+// cost O(N) journal-sized writes.
+func (j *journal) update(path string, state *journalFileState) {
+	j.mu.Lock()
+	j.Files[path] = state
+	j.mu.Unlock()
+}
+
+// flush persists the journal via a temp-file-plus-rename so a crash mid
+// write never leaves a corrupt journal behind.
+func (j *journal) flush() error {
+	j.mu.Lock()
+	data, err := json.Marshal(j)
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// done removes the journal once a restore finished without error; there is
+// nothing left to resume.
+func (j *journal) done() {
+	_ = os.Remove(j.path)
+}
+
+// canSkipRestore reports whether dstPath already holds node's finished
+// content, per the journal from a previous run of the same (tree, dst).
+// dstPath is always the pre-conflict-resolution destination; when the
+// state journaled under it has Path set, that's where the content
+// actually landed (see recordDone) and is what gets stat'd/hashed.
+func (res *Restorer2) canSkipRestore(dstPath string) bool {
+	state := res.journal.get(dstPath)
+	if state == nil || !state.Done {
+		return false
+	}
+
+	actualPath := dstPath
+	if state.Path != "" {
+		actualPath = state.Path
+	}
+
+	fi, err := os.Stat(actualPath)
+	if err != nil || fi.Size() != state.Size || !fi.ModTime().Equal(state.ModTime) {
+		return false
+	}
+
+	if !res.VerifyExisting {
+		return true
+	}
+
+	hash, err := hashFile(actualPath)
+	return err == nil && hash == state.Hash
+}
+
+// recordDone journals journalKey as fully restored, so a later resume can
+// skip it outright. journalKey is the pre-conflict-resolution destination
+// canSkipRestore will look up next time, which isn't necessarily
+// actualPath: a rename conflict means the content actually landed
+// elsewhere, so that mapping is recorded alongside it. Hashing is only
+// worth its cost (a full re-read of the file) when VerifyExisting is set;
+// otherwise canSkipRestore never looks at Hash.
+func (res *Restorer2) recordDone(journalKey, actualPath string) {
+	state := &journalFileState{Done: true}
+	if actualPath != journalKey {
+		state.Path = actualPath
+	}
+
+	if fi, err := os.Stat(actualPath); err == nil {
+		state.Size = fi.Size()
+		state.ModTime = fi.ModTime()
+	}
+	if res.VerifyExisting {
+		if hash, err := hashFile(actualPath); err == nil {
+			state.Hash = hash
+		}
+	}
+
+	res.journal.update(journalKey, state)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
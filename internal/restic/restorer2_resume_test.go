@@ -0,0 +1,113 @@
+package restic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+	dst := t.TempDir()
+	tree := ID{1, 2, 3}
+
+	j := loadJournal(dst, tree)
+	if len(j.Files) != 0 {
+		t.Fatalf("fresh journal has %d files, want 0", len(j.Files))
+	}
+
+	j.update("/foo", &journalFileState{Size: 42, Done: true})
+	if err := j.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := loadJournal(dst, tree)
+	state := reloaded.get("/foo")
+	if state == nil || state.Size != 42 || !state.Done {
+		t.Fatalf("reloaded journal state = %+v, want size 42, done", state)
+	}
+}
+
+func TestJournalLoadIgnoresMismatchedTree(t *testing.T) {
+	dst := t.TempDir()
+
+	j := loadJournal(dst, ID{1})
+	j.update("/foo", &journalFileState{Done: true})
+	if err := j.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := loadJournal(dst, ID{2})
+	if len(reloaded.Files) != 0 {
+		t.Fatalf("journal loaded for a different tree kept %d files, want 0", len(reloaded.Files))
+	}
+}
+
+func TestJournalDoneRemovesFile(t *testing.T) {
+	dst := t.TempDir()
+	tree := ID{1}
+
+	j := loadJournal(dst, tree)
+	j.update("/foo", &journalFileState{Done: true})
+	if err := j.flush(); err != nil {
+		t.Fatal(err)
+	}
+	j.done()
+
+	if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+		t.Fatalf("journal file still exists after done(): err = %v", err)
+	}
+}
+
+func TestCanSkipRestore(t *testing.T) {
+	dst := t.TempDir()
+	path := filepath.Join(dst, "file")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &Restorer2{journal: loadJournal(dst, ID{1})}
+
+	if res.canSkipRestore(path) {
+		t.Fatal("canSkipRestore true before anything was journaled")
+	}
+
+	res.journal.update(path, &journalFileState{Size: fi.Size(), ModTime: fi.ModTime(), Done: true})
+	if !res.canSkipRestore(path) {
+		t.Fatal("canSkipRestore false for a path matching its journaled size/mtime")
+	}
+
+	if err := os.WriteFile(path, []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res.canSkipRestore(path) {
+		t.Fatal("canSkipRestore true after the file changed size")
+	}
+}
+
+// TestCanSkipRestoreFollowsRenamedPath checks that canSkipRestore, given
+// the pre-conflict-resolution path a file was planned at, finds content
+// that actually landed at a renamed sibling path (see recordDone) instead
+// of looking at the pre-conflict path itself.
+func TestCanSkipRestoreFollowsRenamedPath(t *testing.T) {
+	dst := t.TempDir()
+	origPath := filepath.Join(dst, "file")
+	renamedPath := origPath + ".restic-conflict-1"
+
+	if err := os.WriteFile(origPath, []byte("the pre-existing file we didn't overwrite"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(renamedPath, []byte("restored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res := &Restorer2{journal: loadJournal(dst, ID{1})}
+	res.recordDone(origPath, renamedPath)
+
+	if !res.canSkipRestore(origPath) {
+		t.Fatal("canSkipRestore false for a renamed path recorded by recordDone")
+	}
+}
@@ -0,0 +1,69 @@
+package restic
+
+import "os"
+
+// sparseBlockSize is the shortest run of zero bytes worth turning into a
+// hole; shorter runs cost more in syscalls than they save in disk space.
+const sparseBlockSize = 4096
+
+// zeroRuns returns the [start, end) byte ranges within data that are long
+// enough runs of zero bytes to skip writing.
+func zeroRuns(data []byte) [][2]int {
+	var runs [][2]int
+	start := -1
+	for i, b := range data {
+		if b == 0 {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start != -1 {
+			if i-start >= sparseBlockSize {
+				runs = append(runs, [2]int{start, i})
+			}
+			start = -1
+		}
+	}
+	if start != -1 && len(data)-start >= sparseBlockSize {
+		runs = append(runs, [2]int{start, len(data)})
+	}
+	return runs
+}
+
+// writeSparseData writes data at offset in f. When SparseFiles is enabled,
+// long zero runs are turned into holes via punchHole instead of being
+// written out; f was already truncated to its final size by
+// createSizedFile, so a skipped write simply leaves that range as the
+// hole ftruncate/SetEndOfFile created.
+func (res *Restorer2) writeSparseData(f *os.File, offset int64, data []byte) error {
+	if !res.SparseFiles {
+		_, err := f.WriteAt(data, offset)
+		return err
+	}
+
+	runs := zeroRuns(data)
+	if len(runs) == 0 {
+		_, err := f.WriteAt(data, offset)
+		return err
+	}
+
+	cursor := 0
+	for _, run := range runs {
+		if run[0] > cursor {
+			if _, err := f.WriteAt(data[cursor:run[0]], offset+int64(cursor)); err != nil {
+				return err
+			}
+		}
+		if err := punchHole(f, offset+int64(run[0]), int64(run[1]-run[0])); err != nil {
+			return err
+		}
+		cursor = run[1]
+	}
+	if cursor < len(data) {
+		if _, err := f.WriteAt(data[cursor:], offset+int64(cursor)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package restic
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// markSparse is a no-op on Linux: ftruncate already leaves the extended
+// range as a hole on every filesystem that supports sparse files.
+func markSparse(f *os.File) error {
+	return nil
+}
+
+// punchHole deallocates [offset, offset+length) so it reads back as zeros
+// without occupying disk space, in case the range was already allocated
+// (e.g. by a filesystem that preallocates on truncate).
+func punchHole(f *os.File, offset, length int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if err == unix.EOPNOTSUPP {
+		// Filesystem doesn't support hole punching; the range is still
+		// correct, just not sparse.
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
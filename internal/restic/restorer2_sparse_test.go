@@ -0,0 +1,43 @@
+package restic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZeroRuns(t *testing.T) {
+	zeros := func(n int) []byte { return make([]byte, n) }
+
+	var tests = []struct {
+		name string
+		data []byte
+		want [][2]int
+	}{
+		{"empty", nil, nil},
+		{"no zeros", []byte("hello world"), nil},
+		{"short zero run below block size", append([]byte("a"), zeros(10)...), nil},
+		{
+			"long zero run at start",
+			append(zeros(sparseBlockSize), []byte("tail")...),
+			[][2]int{{0, sparseBlockSize}},
+		},
+		{
+			"long zero run at end",
+			append([]byte("head"), zeros(sparseBlockSize)...),
+			[][2]int{{4, 4 + sparseBlockSize}},
+		},
+		{
+			"long zero run in the middle",
+			append(append([]byte("head"), zeros(sparseBlockSize)...), []byte("tail")...),
+			[][2]int{{4, 4 + sparseBlockSize}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := zeroRuns(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("zeroRuns(%d bytes) = %v, want %v", len(tt.data), got, tt.want)
+			}
+		})
+	}
+}
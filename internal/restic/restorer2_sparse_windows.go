@@ -0,0 +1,47 @@
+//go:build windows
+// +build windows
+
+package restic
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	fsctlSetSparse   = 0x000900C4
+	fsctlSetZeroData = 0x000980C8
+)
+
+// fileZeroDataInformation mirrors the FILE_ZERO_DATA_INFORMATION struct
+// expected by FSCTL_SET_ZERO_DATA.
+type fileZeroDataInformation struct {
+	FileOffset      int64
+	BeyondFinalZero int64
+}
+
+// markSparse marks f as a sparse file. Unlike Linux/Darwin, NTFS reserves
+// on-disk space for the whole length set by Truncate unless this is called
+// first, so it must run before any holes can be punched.
+func markSparse(f *os.File) error {
+	var bytesReturned uint32
+	err := windows.DeviceIoControl(windows.Handle(f.Fd()), fsctlSetSparse, nil, 0, nil, 0, &bytesReturned, nil)
+	if err != nil {
+		return &os.PathError{Op: "FSCTL_SET_SPARSE", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// punchHole deallocates [offset, offset+length) on an NTFS sparse file.
+func punchHole(f *os.File, offset, length int64) error {
+	in := fileZeroDataInformation{FileOffset: offset, BeyondFinalZero: offset + length}
+	var bytesReturned uint32
+	err := windows.DeviceIoControl(windows.Handle(f.Fd()), fsctlSetZeroData,
+		(*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)), nil, 0, &bytesReturned, nil)
+	if err != nil {
+		return &os.PathError{Op: "FSCTL_SET_ZERO_DATA", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package restic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCheckCompeletedRestoresNodeTimestamps drives checkCompeleted for a
+// non-root dir task built by newDirTask to completion: it must restore the
+// timestamps of the Node it was walked from onto the directory's restored
+// path below dst, and cascade the completion up to the parent.
+func TestCheckCompeletedRestoresNodeTimestamps(t *testing.T) {
+	root := t.TempDir()
+	childDir := filepath.Join(root, "child")
+	if err := os.Mkdir(childDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1000000000, 0)
+	res := &Restorer2{dst: root}
+	parent := &restoreTask{res: res, class: "dir", dir: string(filepath.Separator), node: nil, child: 1}
+	child := newDirTask(res, parent, filepath.Join(string(filepath.Separator), "child"), ID{},
+		&Node{Type: "dir", Name: "child", ModTime: mtime, AccessTime: mtime})
+
+	if err := child.checkCompeleted(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(childDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("child dir mtime = %v, want %v", fi.ModTime(), mtime)
+	}
+
+	if parent.child != 0 {
+		t.Fatalf("parent.child = %d, want 0 once its only child dir task completed", parent.child)
+	}
+}
+
+// TestCheckCompeletedSkipsRootNode checks that the root dir task, which has
+// no Node of its own (it isn't an entry in any tree), completes without
+// trying to restore timestamps from one.
+func TestCheckCompeletedSkipsRootNode(t *testing.T) {
+	root := &restoreTask{class: "dir", dir: t.TempDir(), node: nil}
+
+	if err := root.checkCompeleted(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMaybeDrainTasksBoundsQueue checks that maybeDrainTasks dispatches
+// queued node tasks to a worker until res.dirTasks+res.nodeTasks is back
+// at or under MaxPendingTasks, instead of letting a single directory's
+// worth of entries accumulate without bound.
+//
+// This is a narrow unit test of the drain loop against bare task stubs,
+// not the ">1M nodes under a memory ceiling" restore this change was
+// requested for: driving an actual walk needs a Repository/tree/pack
+// harness this package doesn't have on its own (LoadTree, Index, and the
+// rest of Restorer live outside this file). It also doesn't exercise
+// checkCompeleted, since these stub tasks have no parent.
+func TestMaybeDrainTasksBoundsQueue(t *testing.T) {
+	res := &Restorer2{workers: 1, MaxPendingTasks: 4}
+	res.available = res.workers
+	res.cfire = make(chan *restoreTask)
+	res.cback = make(chan *restoreTask)
+
+	// Fake worker: immediately completes whatever it's handed, the same
+	// way restoreWorker does for a task with nothing left to do.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for task := range res.cfire {
+			res.cback <- task
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		res.nodeTasks = append(res.nodeTasks, &restoreTask{res: res, class: "node"})
+	}
+
+	if err := res.maybeDrainTasks(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(res.dirTasks) + len(res.nodeTasks); got > res.MaxPendingTasks {
+		t.Errorf("queue length %d exceeds MaxPendingTasks %d", got, res.MaxPendingTasks)
+	}
+
+	close(res.cfire)
+	<-done
+}